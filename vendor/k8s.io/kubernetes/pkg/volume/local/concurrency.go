@@ -0,0 +1,81 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// mountRefsCacheTTL bounds how stale a cached GetMountRefs result may be.
+// It only needs to survive a single burst of concurrent SetUpAt calls
+// against the same globalPath, so it is kept short.
+const mountRefsCacheTTL = 2 * time.Second
+
+type mountRefsCacheEntry struct {
+	refs    []string
+	err     error
+	expires time.Time
+}
+
+// mountRefsCache memoizes GetMountRefs(globalPath) so that N pods mounting
+// the same shared local PV concurrently don't each walk
+// /proc/self/mountinfo to answer the same question.
+type mountRefsCache struct {
+	mu      sync.Mutex
+	entries map[string]mountRefsCacheEntry
+}
+
+func (c *mountRefsCache) get(mounter mount.Interface, globalPath string) ([]string, error) {
+	c.mu.Lock()
+	if entry, ok := c.entries[globalPath]; ok && time.Now().Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.refs, entry.err
+	}
+	c.mu.Unlock()
+
+	refs, err := mounter.GetMountRefs(globalPath)
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[string]mountRefsCacheEntry)
+	}
+	c.entries[globalPath] = mountRefsCacheEntry{refs: refs, err: err, expires: time.Now().Add(mountRefsCacheTTL)}
+	c.mu.Unlock()
+
+	return refs, err
+}
+
+// invalidate drops any cached GetMountRefs result for globalPath. SetUpAt
+// calls this right after a bind mount succeeds, so the fsGroup-mismatch
+// check done by the next pod to mount the same globalPath sees this mount
+// instead of a stale pre-mount snapshot for up to mountRefsCacheTTL.
+func (c *mountRefsCache) invalidate(globalPath string) {
+	c.mu.Lock()
+	delete(c.entries, globalPath)
+	c.mu.Unlock()
+}
+
+// mountKey returns the keymutex key used to shard the bind-mount step of
+// SetUpAt by (globalPath, podUID), instead of serializing every pod sharing
+// globalPath behind a single lock.
+func mountKey(globalPath string, podUID types.UID) string {
+	return globalPath + "/" + string(podUID)
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/pkg/kubelet/events"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+// DevicePreparer transforms a raw local PV device path before it is
+// formatted and mounted, e.g. to unlock a LUKS container, activate an LVM
+// logical volume, or assemble an mdadm array. Preparers are run in
+// registration order on mount, and in reverse order on unmount so the last
+// layer applied is the first one torn down.
+type DevicePreparer interface {
+	// Name identifies the preparer for logging and event messages.
+	Name() string
+	// Prepare is called with the PV's raw devicePath and returns the
+	// devicePath that should be passed to the next preparer (or to
+	// FormatAndMount if this is the last one in the chain).
+	Prepare(spec *volume.Spec, devicePath string) (string, error)
+	// Unprepare undoes Prepare. It receives the same devicePath that was
+	// passed in to the matching Prepare call.
+	Unprepare(spec *volume.Spec, devicePath string) error
+}
+
+// RegisterDevicePreparer adds preparer to the end of the plugin's
+// preparation chain. It is expected to be called from Init by builds that
+// wire up LUKS/LVM/mdadm support, or by tests.
+func (plugin *localVolumePlugin) RegisterDevicePreparer(preparer DevicePreparer) {
+	plugin.devicePreparers = append(plugin.devicePreparers, preparer)
+}
+
+// prepareDevice runs the plugin's preparer chain in order, rolling back any
+// already-applied preparer if a later one fails. Besides the final
+// devicePath to mount, it returns the devicePath each preparer in the chain
+// was given as input, so a later unprepareDevice call can hand every
+// preparer's Unprepare the same devicePath its Prepare received, per the
+// DevicePreparer contract.
+func (dm *deviceMounter) prepareDevice(spec *volume.Spec, devicePath string) (string, []string, error) {
+	applied := make([]DevicePreparer, 0, len(dm.plugin.devicePreparers))
+	inputPaths := make([]string, 0, len(dm.plugin.devicePreparers))
+	path := devicePath
+	for _, preparer := range dm.plugin.devicePreparers {
+		next, err := preparer.Prepare(spec, path)
+		if err != nil {
+			dm.plugin.recorder.Eventf(spec.PersistentVolume, v1.EventTypeWarning, events.FailedMountVolume,
+				"local: device preparer %q failed: %v", preparer.Name(), err)
+			// Roll back what we've already applied, most-recent first, each
+			// with the same devicePath it was given on Prepare.
+			for i := len(applied) - 1; i >= 0; i-- {
+				if unErr := applied[i].Unprepare(spec, inputPaths[i]); unErr != nil {
+					klog.Errorf("local: rollback of preparer %q failed: %v", applied[i].Name(), unErr)
+				}
+			}
+			return "", nil, fmt.Errorf("local: device preparer %q failed on %s: %v", preparer.Name(), devicePath, err)
+		}
+		applied = append(applied, preparer)
+		inputPaths = append(inputPaths, path)
+		path = next
+	}
+	return path, inputPaths, nil
+}
+
+// unprepareDevice runs the plugin's preparer chain in reverse, undoing what
+// prepareDevice applied. inputPaths must be the per-preparer devicePath
+// slice prepareDevice returned, so devicePreparers[i].Unprepare receives the
+// same devicePath devicePreparers[i].Prepare was called with.
+func (dm *deviceMounter) unprepareDevice(spec *volume.Spec, inputPaths []string) error {
+	var lastErr error
+	for i := len(dm.plugin.devicePreparers) - 1; i >= 0; i-- {
+		preparer := dm.plugin.devicePreparers[i]
+		if i >= len(inputPaths) {
+			klog.Errorf("local: no recorded input path for preparer %q, skipping unprepare", preparer.Name())
+			continue
+		}
+		if err := preparer.Unprepare(spec, inputPaths[i]); err != nil {
+			klog.Errorf("local: preparer %q failed to unprepare %s: %v", preparer.Name(), inputPaths[i], err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// preparedDeviceRecord is enough state about a successful prepareDevice call
+// to run unprepareDevice later, when only the deviceMountPath (and thus the
+// PV name, but not the original spec) is available to UnmountDevice.
+type preparedDeviceRecord struct {
+	RawDevicePath string            `json:"rawDevicePath"`
+	PreparedPath  string            `json:"preparedPath"`
+	StepPaths     []string          `json:"stepPaths"`
+	Annotations   map[string]string `json:"annotations"`
+}
+
+func (plugin *localVolumePlugin) preparedDevicesFile() string {
+	return filepath.Join(plugin.host.GetPluginDir(localVolumePluginName), "prepared-devices.json")
+}
+
+func (plugin *localVolumePlugin) loadPreparedDevices() (map[string]preparedDeviceRecord, error) {
+	records := map[string]preparedDeviceRecord{}
+	data, err := ioutil.ReadFile(plugin.preparedDevicesFile())
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (plugin *localVolumePlugin) savePreparedDevices(records map[string]preparedDeviceRecord) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(plugin.preparedDevicesFile(), data, 0600)
+}
+
+// recordPreparedDevice persists the raw/prepared device path pair, and each
+// preparer's own input path, for volName so a later UnmountDevice call can
+// run the preparer chain in reverse without the original spec.
+func (plugin *localVolumePlugin) recordPreparedDevice(volName string, spec *volume.Spec, rawDevicePath, preparedPath string, stepPaths []string) error {
+	if len(plugin.devicePreparers) == 0 {
+		return nil
+	}
+	plugin.preparedDevicesLock.Lock()
+	defer plugin.preparedDevicesLock.Unlock()
+
+	records, err := plugin.loadPreparedDevices()
+	if err != nil {
+		return err
+	}
+	records[volName] = preparedDeviceRecord{
+		RawDevicePath: rawDevicePath,
+		PreparedPath:  preparedPath,
+		StepPaths:     stepPaths,
+		Annotations:   spec.PersistentVolume.Annotations,
+	}
+	return plugin.savePreparedDevices(records)
+}
+
+// unprepareRecordedDevice looks up the preparer-chain record for the PV
+// backing deviceMountPath and runs Unprepare on every registered preparer.
+func (dm *deviceMounter) unprepareRecordedDevice(deviceMountPath string) error {
+	if len(dm.plugin.devicePreparers) == 0 {
+		return nil
+	}
+	volName := filepath.Base(deviceMountPath)
+
+	dm.plugin.preparedDevicesLock.Lock()
+	defer dm.plugin.preparedDevicesLock.Unlock()
+
+	records, err := dm.plugin.loadPreparedDevices()
+	if err != nil {
+		return err
+	}
+	record, ok := records[volName]
+	if !ok {
+		return nil
+	}
+
+	stubSpec := volume.NewSpecFromPersistentVolume(&v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: volName, Annotations: record.Annotations},
+		Spec: v1.PersistentVolumeSpec{
+			PersistentVolumeSource: v1.PersistentVolumeSource{
+				Local: &v1.LocalVolumeSource{Path: record.RawDevicePath},
+			},
+		},
+	}, false)
+	if err := dm.unprepareDevice(stubSpec, record.StepPaths); err != nil {
+		return err
+	}
+
+	delete(records, volName)
+	return dm.plugin.savePreparedDevices(records)
+}
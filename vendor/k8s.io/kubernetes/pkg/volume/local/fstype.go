@@ -0,0 +1,105 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/kubernetes/pkg/kubelet/events"
+	"k8s.io/kubernetes/pkg/volume"
+	"k8s.io/kubernetes/pkg/volume/util"
+)
+
+// localVolumeConfigFile is the name of the cluster-admin-supplied config
+// file, relative to the plugin dir, that sets the cluster-wide default
+// FSType for local PVs that don't request one.
+const localVolumeConfigFile = "local-volume-config.json"
+
+// LocalVolumeConfig lets cluster admins override defaultFSType for local PVs
+// whose PV spec and backing device both leave the filesystem unspecified.
+// It is read from localVolumeConfigFile under the plugin dir, since the
+// VolumePlugin.Init signature has no room for plugin-specific arguments.
+type LocalVolumeConfig struct {
+	DefaultFSType string `json:"defaultFSType"`
+}
+
+func (plugin *localVolumePlugin) loadLocalVolumeConfig() (*LocalVolumeConfig, error) {
+	path := filepath.Join(plugin.host.GetPluginDir(localVolumePluginName), localVolumeConfigFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &LocalVolumeConfig{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("local: failed to read %s: %v", path, err)
+	}
+	cfg := &LocalVolumeConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("local: failed to parse %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// getVolumeSourceFSType determines the filesystem type to mount devicePath
+// with. It prefers whatever filesystem is already on disk so an existing
+// PV is never silently reformatted; only an unformatted device falls back
+// to the PV spec's requested FSType, then the cluster-wide default from
+// LocalVolumeConfig, then defaultFSType.
+func (plugin *localVolumePlugin) getVolumeSourceFSType(spec *volume.Spec, devicePath string) (string, error) {
+	if spec.PersistentVolume == nil || spec.PersistentVolume.Spec.Local == nil {
+		return "", fmt.Errorf("spec does not reference a Local volume type")
+	}
+
+	requested := ""
+	if spec.PersistentVolume.Spec.Local.FSType != nil {
+		requested = *spec.PersistentVolume.Spec.Local.FSType
+	}
+
+	detected, err := util.DetectDeviceFSType(plugin.exec, devicePath)
+	if err != nil {
+		klog.Warningf("local: failed to detect filesystem type of %s, falling back to requested/default: %v", devicePath, err)
+		detected = ""
+	}
+
+	if detected != "" {
+		if requested != "" && requested != detected {
+			plugin.recorder.Eventf(spec.PersistentVolume, v1.EventTypeWarning, events.FailedMountVolume,
+				"local: PV %s requests FSType %q but device %s is already formatted as %q; mounting as %q",
+				spec.Name(), requested, devicePath, detected, detected)
+		}
+		return detected, nil
+	}
+
+	if requested != "" {
+		return requested, nil
+	}
+
+	cfg, err := plugin.loadLocalVolumeConfig()
+	if err != nil {
+		return "", err
+	}
+	if cfg.DefaultFSType != "" {
+		return cfg.DefaultFSType, nil
+	}
+	return defaultFSType, nil
+}
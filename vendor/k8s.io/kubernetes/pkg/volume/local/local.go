@@ -22,6 +22,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	"k8s.io/klog"
 
@@ -32,8 +33,10 @@ import (
 	"k8s.io/kubernetes/pkg/kubelet/events"
 	"k8s.io/kubernetes/pkg/util/mount"
 	"k8s.io/kubernetes/pkg/volume"
+	"k8s.io/kubernetes/pkg/volume/local/subpathallocator"
 	"k8s.io/kubernetes/pkg/volume/util"
 	"k8s.io/kubernetes/pkg/volume/validation"
+	utilexec "k8s.io/utils/exec"
 	"k8s.io/utils/keymutex"
 	utilstrings "k8s.io/utils/strings"
 )
@@ -51,6 +54,59 @@ type localVolumePlugin struct {
 	host        volume.VolumeHost
 	volumeLocks keymutex.KeyMutex
 	recorder    record.EventRecorder
+
+	// mountLocks shards the bind-mount step of SetUpAt by (globalPath,
+	// podUID) so that pods sharing a local PV (e.g. via subpath allocation)
+	// don't serialize behind a single lock on globalPath. The one-time
+	// fsGroup-check and SetVolumeOwnership path still uses volumeLocks.
+	mountLocks keymutex.KeyMutex
+	// mountRefsCache memoizes GetMountRefs lookups across a burst of
+	// concurrent SetUpAt calls against the same globalPath.
+	mountRefsCache mountRefsCache
+
+	// subpathAllocator and subpathAllocatorLock back PVs that opt in to
+	// allocatorModeSubpath; they are created lazily since most clusters
+	// never use the feature.
+	subpathAllocator     *subpathallocator.Allocator
+	subpathAllocatorLock sync.Mutex
+	// subpathMounts tracks the running accounting goroutine for each
+	// (volName, podUID) started by startSubpathAccounting, so TearDownAt
+	// can stop it and release the allocator reservation once unused. See
+	// stopSubpathAccounting.
+	subpathMounts   map[string]chan struct{}
+	subpathMountsMu sync.Mutex
+
+	// devicePreparers run, in order, on a block PV's raw devicePath before
+	// it is formatted and mounted, and in reverse order on teardown. See
+	// RegisterDevicePreparer.
+	devicePreparers []DevicePreparer
+	// preparedDevicesLock guards the load-modify-save cycle over the
+	// prepared-devices state file so concurrent MountDevice/UnmountDevice
+	// calls for different block PVs don't race and drop each other's record.
+	preparedDevicesLock sync.Mutex
+
+	// exec runs the findmnt/blkid/xfs_quota/cryptsetup/lvchange/mdadm
+	// helper commands this plugin shells out to (volume path
+	// reconstruction, filesystem detection, subpath quota enforcement, and
+	// the device preparer chain); it is swapped out for a fake in tests.
+	exec utilexec.Interface
+
+	// setVolumeOwnership performs the one-time recursive chown SetUpAt runs
+	// for the first pod to mount a globalPath. It is volume.SetVolumeOwnership
+	// by default (see volumeOwnershipSetter); tests swap in a fake that
+	// counts calls instead, since the real one touches the filesystem and
+	// gives no other way to observe how many times it ran.
+	setVolumeOwnership func(mounter volume.Mounter, fsGroup *int64) error
+}
+
+// volumeOwnershipSetter returns plugin.setVolumeOwnership, falling back to
+// volume.SetVolumeOwnership for plugins (like fakes built directly in
+// tests) that never set the field.
+func (plugin *localVolumePlugin) volumeOwnershipSetter() func(volume.Mounter, *int64) error {
+	if plugin.setVolumeOwnership != nil {
+		return plugin.setVolumeOwnership
+	}
+	return volume.SetVolumeOwnership
 }
 
 var _ volume.VolumePlugin = &localVolumePlugin{}
@@ -64,7 +120,13 @@ const (
 func (plugin *localVolumePlugin) Init(host volume.VolumeHost) error {
 	plugin.host = host
 	plugin.volumeLocks = keymutex.NewHashed(0)
+	plugin.mountLocks = keymutex.NewHashed(0)
 	plugin.recorder = host.GetEventRecorder()
+	plugin.exec = utilexec.New()
+	plugin.setVolumeOwnership = volume.SetVolumeOwnership
+	plugin.RegisterDevicePreparer(LUKSPreparer{Exec: plugin.exec})
+	plugin.RegisterDevicePreparer(LVMPreparer{Exec: plugin.exec})
+	plugin.RegisterDevicePreparer(MDADMPreparer{Exec: plugin.exec})
 	return nil
 }
 
@@ -124,7 +186,17 @@ func (plugin *localVolumePlugin) NewMounter(spec *volume.Spec, pod *v1.Pod, _ vo
 		return nil, err
 	}
 
-	return &localVolumeMounter{
+	var reservedBytes int64
+	if usesSubpathAllocator(spec) {
+		subPath, err := plugin.reserveSubpath(spec, globalLocalPath)
+		if err != nil {
+			return nil, err
+		}
+		globalLocalPath = subPath
+		reservedBytes = spec.PersistentVolume.Spec.Capacity[v1.ResourceStorage].Value()
+	}
+
+	mounter := &localVolumeMounter{
 		localVolume: &localVolume{
 			pod:             pod,
 			podUID:          pod.UID,
@@ -136,8 +208,13 @@ func (plugin *localVolumePlugin) NewMounter(spec *volume.Spec, pod *v1.Pod, _ vo
 		},
 		mountOptions: util.MountOptionFromSpec(spec),
 		readOnly:     readOnly,
-	}, nil
+	}
 
+	if reservedBytes > 0 {
+		plugin.startSubpathAccounting(mounter, reservedBytes)
+	}
+
+	return mounter, nil
 }
 
 func (plugin *localVolumePlugin) NewUnmounter(volName string, podUID types.UID) (volume.Unmounter, error) {
@@ -184,15 +261,38 @@ func (plugin *localVolumePlugin) NewBlockVolumeUnmapper(volName string,
 // TODO: check if no path and no topology constraints are ok
 func (plugin *localVolumePlugin) ConstructVolumeSpec(volumeName, mountPath string) (*volume.Spec, error) {
 	fs := v1.PersistentVolumeFilesystem
+	localSource := &v1.LocalVolumeSource{}
+
+	// Subpath-allocator PVs don't bind-mount the PV's own globalPath, so
+	// findmnt below would recover the wrong (shared) directory for them.
+	// Check the allocator's own bookkeeping first; it is authoritative for
+	// these PVs and survives a kubelet restart just as well as findmnt does.
+	if allocator, err := plugin.getSubpathAllocator(); err != nil {
+		klog.Warningf("local: could not load subpath allocator state while reconstructing volume %s: %v", volumeName, err)
+	} else if _, subPath, ok := allocator.Lookup(volumeName); ok {
+		localSource.Path = subPath
+	}
+
+	if localSource.Path == "" {
+		if path, fsType, err := plugin.reconstructLocalPath(mountPath); err != nil {
+			// Leaving Local.Path empty keeps the previous (safe) behavior of
+			// skipping device unmount reconstruction for this volume.
+			klog.Warningf("local: could not reconstruct Local.Path for volume %s at %s, device unmount reconciliation will be skipped: %v", volumeName, mountPath, err)
+		} else {
+			localSource.Path = path
+			if fsType != "" {
+				localSource.FSType = &fsType
+			}
+		}
+	}
+
 	localVolume := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: volumeName,
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				Local: &v1.LocalVolumeSource{
-					Path: "",
-				},
+				Local: localSource,
 			},
 			VolumeMode: &fs,
 		},
@@ -203,6 +303,12 @@ func (plugin *localVolumePlugin) ConstructVolumeSpec(volumeName, mountPath strin
 func (plugin *localVolumePlugin) ConstructBlockVolumeSpec(podUID types.UID, volumeName,
 	mapPath string) (*volume.Spec, error) {
 	block := v1.PersistentVolumeBlock
+	localSource := &v1.LocalVolumeSource{}
+	if path, err := plugin.reconstructBlockDevicePath(volumeName, mapPath); err != nil {
+		klog.Warningf("local: could not reconstruct Local.Path for block volume %s at %s, device unmount reconciliation will be skipped: %v", volumeName, mapPath, err)
+	} else {
+		localSource.Path = path
+	}
 
 	localVolume := &v1.PersistentVolume{
 		ObjectMeta: metav1.ObjectMeta{
@@ -210,9 +316,7 @@ func (plugin *localVolumePlugin) ConstructBlockVolumeSpec(podUID types.UID, volu
 		},
 		Spec: v1.PersistentVolumeSpec{
 			PersistentVolumeSource: v1.PersistentVolumeSource{
-				Local: &v1.LocalVolumeSource{
-					Path: "",
-				},
+				Local: localSource,
 			},
 			VolumeMode: &block,
 		},
@@ -230,6 +334,12 @@ func (plugin *localVolumePlugin) getGlobalLocalPath(spec *volume.Spec) (string,
 		return "", fmt.Errorf("local volume source is nil or local path is not set")
 	}
 
+	if _, _, ok := parseMemBackedSource(spec.PersistentVolume.Spec.Local.Path); ok {
+		// tmpfs/ramfs volumes have no backing directory or device to stat;
+		// MountDevice mounts a fresh one at this computed global path.
+		return filepath.Join(plugin.generateBlockDeviceBaseGlobalPath(), spec.Name()), nil
+	}
+
 	fileType, err := plugin.host.GetMounter(plugin.GetPluginName()).GetFileType(spec.PersistentVolume.Spec.Local.Path)
 	if err != nil {
 		return "", err
@@ -276,7 +386,7 @@ func (dm *deviceMounter) mountLocalBlockDevice(spec *volume.Spec, devicePath str
 	if !notMnt {
 		return nil
 	}
-	fstype, err := getVolumeSourceFSType(spec)
+	fstype, err := dm.plugin.getVolumeSourceFSType(spec, devicePath)
 	if err != nil {
 		return err
 	}
@@ -303,6 +413,11 @@ func (dm *deviceMounter) MountDevice(spec *volume.Spec, devicePath string, devic
 	if spec.PersistentVolume.Spec.Local == nil || len(spec.PersistentVolume.Spec.Local.Path) == 0 {
 		return fmt.Errorf("local volume source is nil or local path is not set")
 	}
+
+	if fsType, size, ok := parseMemBackedSource(spec.PersistentVolume.Spec.Local.Path); ok {
+		return dm.mountMemBackedVolume(spec, fsType, size, deviceMountPath)
+	}
+
 	fileType, err := dm.mounter.GetFileType(spec.PersistentVolume.Spec.Local.Path)
 	if err != nil {
 		return err
@@ -312,7 +427,14 @@ func (dm *deviceMounter) MountDevice(spec *volume.Spec, devicePath string, devic
 	case mount.FileTypeBlockDev:
 		// local volume plugin does not implement AttachableVolumePlugin interface, so set devicePath to Path in PV spec directly
 		devicePath = spec.PersistentVolume.Spec.Local.Path
-		return dm.mountLocalBlockDevice(spec, devicePath, deviceMountPath)
+		preparedPath, stepPaths, err := dm.prepareDevice(spec, devicePath)
+		if err != nil {
+			return err
+		}
+		if err := dm.plugin.recordPreparedDevice(spec.Name(), spec, devicePath, preparedPath, stepPaths); err != nil {
+			klog.Errorf("local: failed to persist device preparer state for %s: %v", spec.Name(), err)
+		}
+		return dm.mountLocalBlockDevice(spec, preparedPath, deviceMountPath)
 	case mount.FileTypeDirectory:
 		// if the given local volume path is of already filesystem directory, return directly
 		return nil
@@ -321,19 +443,6 @@ func (dm *deviceMounter) MountDevice(spec *volume.Spec, devicePath string, devic
 	}
 }
 
-func getVolumeSourceFSType(spec *volume.Spec) (string, error) {
-	if spec.PersistentVolume != nil &&
-		spec.PersistentVolume.Spec.Local != nil {
-		if spec.PersistentVolume.Spec.Local.FSType != nil {
-			return *spec.PersistentVolume.Spec.Local.FSType, nil
-		}
-		// if the FSType is not set in local PV spec, setting it to default ("ext4")
-		return defaultFSType, nil
-	}
-
-	return "", fmt.Errorf("spec does not reference a Local volume type")
-}
-
 func getVolumeSourceReadOnly(spec *volume.Spec) (bool, error) {
 	if spec.PersistentVolume != nil &&
 		spec.PersistentVolume.Spec.Local != nil {
@@ -371,7 +480,10 @@ func (dm *deviceMounter) UnmountDevice(deviceMountPath string) error {
 	// has base mount path: /var/lib/kubelet/plugins/kubernetes.io/local-volume/mounts
 	basemountPath := dm.plugin.generateBlockDeviceBaseGlobalPath()
 	if mount.PathWithinBase(deviceMountPath, basemountPath) {
-		return mount.CleanupMountPoint(deviceMountPath, dm.mounter, false)
+		if err := mount.CleanupMountPoint(deviceMountPath, dm.mounter, false); err != nil {
+			return err
+		}
+		return dm.unprepareRecordedDevice(deviceMountPath)
 	}
 
 	return nil
@@ -425,8 +537,12 @@ func (m *localVolumeMounter) SetUp(fsGroup *int64) error {
 
 // SetUpAt bind mounts the directory to the volume path and sets up volume ownership
 func (m *localVolumeMounter) SetUpAt(dir string, fsGroup *int64) error {
-	m.plugin.volumeLocks.LockKey(m.globalPath)
-	defer m.plugin.volumeLocks.UnlockKey(m.globalPath)
+	// The bind-mount step only needs to be serialized against other mounts
+	// of the same PV into the same pod; shard on (globalPath, podUID) so
+	// hundreds of pods sharing one local PV don't queue behind each other.
+	key := mountKey(m.globalPath, m.podUID)
+	m.plugin.mountLocks.LockKey(key)
+	defer m.plugin.mountLocks.UnlockKey(key)
 
 	if m.globalPath == "" {
 		return fmt.Errorf("LocalVolume volume %q path is empty", m.volName)
@@ -447,27 +563,6 @@ func (m *localVolumeMounter) SetUpAt(dir string, fsGroup *int64) error {
 	if !notMnt {
 		return nil
 	}
-	refs, err := m.mounter.GetMountRefs(m.globalPath)
-	if fsGroup != nil {
-		if err != nil {
-			klog.Errorf("cannot collect mounting information: %s %v", m.globalPath, err)
-			return err
-		}
-
-		// Only count mounts from other pods
-		refs = m.filterPodMounts(refs)
-		if len(refs) > 0 {
-			fsGroupNew := int64(*fsGroup)
-			fsGroupOld, err := m.mounter.GetFSGroup(m.globalPath)
-			if err != nil {
-				return fmt.Errorf("failed to check fsGroup for %s (%v)", m.globalPath, err)
-			}
-			if fsGroupNew != fsGroupOld {
-				m.plugin.recorder.Eventf(m.pod, v1.EventTypeWarning, events.WarnAlreadyMountedVolume, "The requested fsGroup is %d, but the volume %s has GID %d. The volume may not be shareable.", fsGroupNew, m.volName, fsGroupOld)
-			}
-		}
-
-	}
 
 	if runtime.GOOS != "windows" {
 		// skip below MkdirAll for windows since the "bind mount" logic is implemented differently in mount_wiondows.go
@@ -512,12 +607,56 @@ func (m *localVolumeMounter) SetUpAt(dir string, fsGroup *int64) error {
 		os.Remove(dir)
 		return err
 	}
-	if !m.readOnly {
-		// Volume owner will be written only once on the first volume mount
-		if len(refs) == 0 {
-			return volume.SetVolumeOwnership(m, fsGroup)
+	// Invalidate the cached GetMountRefs result now that this mount exists,
+	// so the re-read below (and any other pod's) sees it instead of a stale
+	// pre-mount snapshot.
+	m.plugin.mountRefsCache.invalidate(m.globalPath)
+
+	// The fsGroup mismatch check and the "write owner once" decision both
+	// read shared, PV-wide state, so they're serialized behind the coarser
+	// globalPath lock and re-read refs here, after this pod's own mount
+	// above: under concurrent first mounts of the same globalPath, a refs
+	// snapshot taken before any of them mounted would read as empty for
+	// every one of them. Post-mount, concurrent first mounts can instead
+	// each see the others, so "no other mounts" can't pick the owner
+	// either; the owner is the pod whose mount is listed first, which every
+	// post-mount read agrees on.
+	m.plugin.volumeLocks.LockKey(m.globalPath)
+	defer m.plugin.volumeLocks.UnlockKey(m.globalPath)
+
+	refs, err := m.plugin.mountRefsCache.get(m.mounter, m.globalPath)
+	if err != nil {
+		klog.Errorf("cannot collect mounting information: %s %v", m.globalPath, err)
+		return err
+	}
+	// Only count mounts from other pods, and exclude this pod's own
+	// just-created bind mount from that count.
+	podRefs := m.filterPodMounts(refs)
+	otherRefs := make([]string, 0, len(podRefs))
+	for _, r := range podRefs {
+		if r != dir {
+			otherRefs = append(otherRefs, r)
 		}
 	}
+
+	if fsGroup != nil && len(otherRefs) > 0 {
+		fsGroupNew := int64(*fsGroup)
+		fsGroupOld, err := m.mounter.GetFSGroup(m.globalPath)
+		if err != nil {
+			return fmt.Errorf("failed to check fsGroup for %s (%v)", m.globalPath, err)
+		}
+		if fsGroupNew != fsGroupOld {
+			m.plugin.recorder.Eventf(m.pod, v1.EventTypeWarning, events.WarnAlreadyMountedVolume, "The requested fsGroup is %d, but the volume %s has GID %d. The volume may not be shareable.", fsGroupNew, m.volName, fsGroupOld)
+		}
+	}
+
+	// GetMountRefs lists mounts in mount order, so the first pod mount in
+	// refs is the earliest one still present.
+	firstMount := len(podRefs) == 0 || podRefs[0] == dir
+	if !m.readOnly && firstMount {
+		// Volume owner will be written only once on the first volume mount.
+		return m.plugin.volumeOwnershipSetter()(m, fsGroup)
+	}
 	return nil
 }
 
@@ -546,7 +685,11 @@ func (u *localVolumeUnmounter) TearDown() error {
 // TearDownAt unmounts the bind mount
 func (u *localVolumeUnmounter) TearDownAt(dir string) error {
 	klog.V(4).Infof("Unmounting volume %q at path %q\n", u.volName, dir)
-	return mount.CleanupMountPoint(dir, u.mounter, true) /* extensiveMountPointCheck = true */
+	err := mount.CleanupMountPoint(dir, u.mounter, true) /* extensiveMountPointCheck = true */
+	// No-op for volumes that never used subpath allocation; see
+	// stopSubpathAccounting.
+	u.plugin.stopSubpathAccounting(u.volName, u.podUID, u.mounter)
+	return err
 }
 
 // localVolumeMapper implements the BlockVolumeMapper interface for local volumes.
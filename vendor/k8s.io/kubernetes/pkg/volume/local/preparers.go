@@ -0,0 +1,183 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/volume"
+	utilexec "k8s.io/utils/exec"
+)
+
+const (
+	// luksKeyFileAnnotation names the node-local file holding the LUKS
+	// passphrase for a PV's backing device. There is no first-class
+	// SecretRef on LocalVolumeSource, so operators stage the key file on
+	// each node (e.g. via a DaemonSet) and reference it by path here.
+	luksKeyFileAnnotation = "local.kubernetes.io/luks-key-file"
+	// lvmVolumeGroupAnnotation and lvmLogicalVolumeAnnotation identify the
+	// VG/LV pair the LVMPreparer should activate.
+	lvmVolumeGroupAnnotation   = "local.kubernetes.io/lvm-vg"
+	lvmLogicalVolumeAnnotation = "local.kubernetes.io/lvm-lv"
+	// mdadmConfigAnnotation points at the mdadm.conf-style config fragment
+	// describing the array to assemble.
+	mdadmConfigAnnotation = "local.kubernetes.io/mdadm-config"
+)
+
+func annotation(spec *volume.Spec, key string) (string, bool) {
+	if spec.PersistentVolume == nil {
+		return "", false
+	}
+	v, ok := spec.PersistentVolume.Annotations[key]
+	return v, ok
+}
+
+// LUKSPreparer opens a LUKS-encrypted block device, returning the decrypted
+// /dev/mapper/<pv-name> mapping to be formatted and mounted in its place.
+type LUKSPreparer struct {
+	// Exec runs the cryptsetup commands; it is swapped out for a fake in
+	// tests. Zero value falls back to utilexec.New() so callers that build
+	// a LUKSPreparer{} directly keep working.
+	Exec utilexec.Interface
+}
+
+var _ DevicePreparer = LUKSPreparer{}
+
+func (p LUKSPreparer) exec() utilexec.Interface {
+	if p.Exec != nil {
+		return p.Exec
+	}
+	return utilexec.New()
+}
+
+func (LUKSPreparer) Name() string { return "luks" }
+
+func (p LUKSPreparer) Prepare(spec *volume.Spec, devicePath string) (string, error) {
+	keyFile, ok := annotation(spec, luksKeyFileAnnotation)
+	if !ok {
+		// Not a LUKS-backed PV; pass the device through unchanged.
+		return devicePath, nil
+	}
+	mapperName := spec.Name()
+	out, err := p.exec().Command("cryptsetup", "luksOpen", "--key-file", keyFile, devicePath, mapperName).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("cryptsetup luksOpen %s: %v (%s)", devicePath, err, strings.TrimSpace(string(out)))
+	}
+	return "/dev/mapper/" + mapperName, nil
+}
+
+func (p LUKSPreparer) Unprepare(spec *volume.Spec, devicePath string) error {
+	if _, ok := annotation(spec, luksKeyFileAnnotation); !ok {
+		return nil
+	}
+	out, err := p.exec().Command("cryptsetup", "luksClose", spec.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("cryptsetup luksClose %s: %v (%s)", spec.Name(), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// LVMPreparer activates the logical volume named by the lvmVolumeGroupAnnotation
+// and lvmLogicalVolumeAnnotation annotations, returning its /dev/<vg>/<lv> path.
+type LVMPreparer struct {
+	// Exec runs the lvchange commands; it is swapped out for a fake in
+	// tests. Zero value falls back to utilexec.New().
+	Exec utilexec.Interface
+}
+
+var _ DevicePreparer = LVMPreparer{}
+
+func (p LVMPreparer) exec() utilexec.Interface {
+	if p.Exec != nil {
+		return p.Exec
+	}
+	return utilexec.New()
+}
+
+func (LVMPreparer) Name() string { return "lvm" }
+
+func (p LVMPreparer) Prepare(spec *volume.Spec, devicePath string) (string, error) {
+	vg, ok := annotation(spec, lvmVolumeGroupAnnotation)
+	if !ok {
+		return devicePath, nil
+	}
+	lv, ok := annotation(spec, lvmLogicalVolumeAnnotation)
+	if !ok {
+		return "", fmt.Errorf("local: PV %s sets %s but not %s", spec.Name(), lvmVolumeGroupAnnotation, lvmLogicalVolumeAnnotation)
+	}
+	out, err := p.exec().Command("lvchange", "-ay", fmt.Sprintf("%s/%s", vg, lv)).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("lvchange -ay %s/%s: %v (%s)", vg, lv, err, strings.TrimSpace(string(out)))
+	}
+	return fmt.Sprintf("/dev/%s/%s", vg, lv), nil
+}
+
+func (p LVMPreparer) Unprepare(spec *volume.Spec, devicePath string) error {
+	vg, ok := annotation(spec, lvmVolumeGroupAnnotation)
+	if !ok {
+		return nil
+	}
+	lv := spec.PersistentVolume.Annotations[lvmLogicalVolumeAnnotation]
+	out, err := p.exec().Command("lvchange", "-an", fmt.Sprintf("%s/%s", vg, lv)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("lvchange -an %s/%s: %v (%s)", vg, lv, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// MDADMPreparer assembles an mdadm array described by the mdadmConfigAnnotation
+// before the device is formatted and mounted.
+type MDADMPreparer struct {
+	// Exec runs the mdadm commands; it is swapped out for a fake in tests.
+	// Zero value falls back to utilexec.New().
+	Exec utilexec.Interface
+}
+
+var _ DevicePreparer = MDADMPreparer{}
+
+func (p MDADMPreparer) exec() utilexec.Interface {
+	if p.Exec != nil {
+		return p.Exec
+	}
+	return utilexec.New()
+}
+
+func (MDADMPreparer) Name() string { return "mdadm" }
+
+func (p MDADMPreparer) Prepare(spec *volume.Spec, devicePath string) (string, error) {
+	configPath, ok := annotation(spec, mdadmConfigAnnotation)
+	if !ok {
+		return devicePath, nil
+	}
+	out, err := p.exec().Command("mdadm", "--assemble", devicePath, "--config", configPath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("mdadm --assemble %s: %v (%s)", devicePath, err, strings.TrimSpace(string(out)))
+	}
+	return devicePath, nil
+}
+
+func (p MDADMPreparer) Unprepare(spec *volume.Spec, devicePath string) error {
+	if _, ok := annotation(spec, mdadmConfigAnnotation); !ok {
+		return nil
+	}
+	out, err := p.exec().Command("mdadm", "--stop", devicePath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("mdadm --stop %s: %v (%s)", devicePath, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
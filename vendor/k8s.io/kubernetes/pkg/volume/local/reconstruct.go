@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// reconstructLocalPath recovers the Local.Path (and, where known, the
+// FSType) that produced the bind mount at mountPath, by asking findmnt to
+// resolve its underlying source through /proc/self/mountinfo. Without this,
+// ConstructVolumeSpec would return a PV spec with no Local.Path, which
+// causes the volume manager to skip device unmount reconstruction entirely
+// after a kubelet restart.
+func (plugin *localVolumePlugin) reconstructLocalPath(mountPath string) (path string, fsType string, err error) {
+	out, err := plugin.exec.Command("findmnt", "-n", "-o", "SOURCE,FSTYPE", "--target", mountPath).CombinedOutput()
+	if err != nil {
+		return "", "", fmt.Errorf("findmnt --target %s: %v (%s)", mountPath, err, strings.TrimSpace(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 {
+		return "", "", fmt.Errorf("unexpected findmnt output for %s: %q", mountPath, out)
+	}
+	source, fsType := fields[0], fields[1]
+
+	// A bind-mounted subdirectory is reported as "<device>[<subpath>]"; the
+	// directory PV's real Local.Path is that device's own mountpoint joined
+	// with the subpath.
+	if idx := strings.Index(source, "["); idx >= 0 && strings.HasSuffix(source, "]") {
+		device := source[:idx]
+		subPath := source[idx+1 : len(source)-1]
+		deviceMountPoint, err := plugin.deviceMountPoint(device)
+		if err != nil {
+			return "", "", err
+		}
+		return filepath.Join(deviceMountPoint, subPath), fsType, nil
+	}
+
+	// No "[subpath]" suffix: source is a bare device, which is ambiguous
+	// between a raw block-device PV (Local.Path is that device node) and a
+	// directory PV whose Local.Path is that device's own mountpoint (the
+	// standard local-static-provisioner layout of a whole dedicated disk
+	// mounted as a directory). Resolve it by checking where the device is
+	// actually mounted: MountDevice only ever mounts a block-device PV's
+	// device under generateBlockDeviceBaseGlobalPath(), so if that's not
+	// where we find it, this plugin never ran MountDevice on it and the
+	// device's own mountpoint is the real Local.Path.
+	deviceMountPoint, err := plugin.deviceMountPoint(source)
+	if err != nil {
+		return "", "", err
+	}
+	if mount.PathWithinBase(deviceMountPoint, plugin.generateBlockDeviceBaseGlobalPath()) {
+		return source, fsType, nil
+	}
+	return deviceMountPoint, fsType, nil
+}
+
+// deviceMountPoint returns the mountpoint a device is mounted at, as
+// reported by findmnt.
+func (plugin *localVolumePlugin) deviceMountPoint(device string) (string, error) {
+	out, err := plugin.exec.Command("findmnt", "-n", "-o", "TARGET", device).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("findmnt %s: %v (%s)", device, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// reconstructBlockDevicePath recovers the raw block device backing a local
+// PV's volumeDevices map entry: MapBlockVolume leaves a symlink named
+// volumeName inside mapPath pointing at the host device node.
+func (plugin *localVolumePlugin) reconstructBlockDevicePath(volumeName, mapPath string) (string, error) {
+	linkPath := filepath.Join(mapPath, volumeName)
+	devicePath, err := os.Readlink(linkPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve block device symlink %s: %v", linkPath, err)
+	}
+	return devicePath, nil
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/util/mount"
+	volumetest "k8s.io/kubernetes/pkg/volume/testing"
+	utilexec "k8s.io/utils/exec"
+	fakeexec "k8s.io/utils/exec/testing"
+)
+
+// fakeExecFindmnt returns a fake exec.Interface that answers sequential
+// findmnt invocations (the "--target" lookup, then, for a bare device
+// source, the device's own "TARGET" lookup that disambiguates a raw
+// block-device PV from a directory PV that is itself a mountpoint).
+func fakeExecFindmnt(t *testing.T, outputs ...string) utilexec.Interface {
+	t.Helper()
+	actions := make([]fakeexec.FakeCommandAction, 0, len(outputs))
+	for _, out := range outputs {
+		out := out
+		actions = append(actions, func(cmd string, args ...string) utilexec.Cmd {
+			return &fakeexec.FakeCmd{
+				CombinedOutputScript: []fakeexec.FakeCombinedOutputAction{
+					func() ([]byte, error) { return []byte(out), nil },
+				},
+			}
+		})
+	}
+	return &fakeexec.FakeExec{CommandScript: actions}
+}
+
+// fakeFindmnt returns a plugin wired with a fake volume host and the fake
+// exec.Interface from fakeExecFindmnt.
+func fakeFindmnt(t *testing.T, outputs ...string) *localVolumePlugin {
+	t.Helper()
+	return &localVolumePlugin{
+		host: volumetest.NewFakeVolumeHost(t, t.TempDir(), nil, nil),
+		exec: fakeExecFindmnt(t, outputs...),
+	}
+}
+
+func TestReconstructLocalPath_DirectoryBindMount(t *testing.T) {
+	// findmnt reports the bracketed root relative to the filesystem root, so
+	// a device mounted at /export with subpath pv1 is reported as
+	// "/dev/sdb1[/pv1]", not "/dev/sdb1[/export/pv1]".
+	plugin := fakeFindmnt(t, "/dev/sdb1[/pv1] ext4\n", "/export\n")
+
+	path, fsType, err := plugin.reconstructLocalPath("/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~local-volume/pv1")
+	if err != nil {
+		t.Fatalf("reconstructLocalPath: %v", err)
+	}
+	if path != "/export/pv1" {
+		t.Errorf("path = %q, want /export/pv1", path)
+	}
+	if fsType != "ext4" {
+		t.Errorf("fsType = %q, want ext4", fsType)
+	}
+}
+
+func TestReconstructLocalPath_DirectoryBindMount_SameDeviceOverlap(t *testing.T) {
+	// The subpath happens to repeat the mountpoint's own last element
+	// ("/export/export-pv1"); the join must not collapse or dedupe that
+	// overlap, since it's just an ordinary path segment from findmnt.
+	plugin := fakeFindmnt(t, "/dev/sdb1[/export-pv1] ext4\n", "/export\n")
+
+	path, fsType, err := plugin.reconstructLocalPath("/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~local-volume/pv1")
+	if err != nil {
+		t.Fatalf("reconstructLocalPath: %v", err)
+	}
+	if path != "/export/export-pv1" {
+		t.Errorf("path = %q, want /export/export-pv1", path)
+	}
+	if fsType != "ext4" {
+		t.Errorf("fsType = %q, want ext4", fsType)
+	}
+}
+
+func TestReconstructLocalPath_RawBlockDevice(t *testing.T) {
+	// Second findmnt call resolves where /dev/sdc is actually mounted: under
+	// the plugin's global mount dir means MountDevice put it there, so
+	// Local.Path is the raw device itself. The fake host's global mount dir
+	// has to be known before building the fake findmnt output, so the host
+	// is built directly here instead of through fakeFindmnt.
+	plugin := &localVolumePlugin{host: volumetest.NewFakeVolumeHost(t, t.TempDir(), nil, nil)}
+	base := filepath.Join(plugin.generateBlockDeviceBaseGlobalPath(), "pv2")
+	plugin.exec = fakeExecFindmnt(t, "/dev/sdc xfs\n", base+"\n")
+
+	path, fsType, err := plugin.reconstructLocalPath(base)
+	if err != nil {
+		t.Fatalf("reconstructLocalPath: %v", err)
+	}
+	if path != "/dev/sdc" {
+		t.Errorf("path = %q, want /dev/sdc", path)
+	}
+	if fsType != "xfs" {
+		t.Errorf("fsType = %q, want xfs", fsType)
+	}
+
+	// A reconstructed deviceMountPath under the plugin's global mount dir is
+	// exactly the signal UnmountDevice uses to decide a real unmount cycle
+	// is needed, instead of silently skipping it as the pre-fix code did.
+	if !mount.PathWithinBase(base, plugin.generateBlockDeviceBaseGlobalPath()) {
+		t.Errorf("expected reconstructed deviceMountPath to be recognized as within the global mount base")
+	}
+}
+
+// TestReconstructLocalPath_DirectoryIsOwnMountpoint covers a directory PV
+// backed by a dedicated disk mounted directly as the PV's Local.Path (the
+// standard local-static-provisioner layout), as opposed to a raw
+// block-device PV. Both report a bare device with no "[subpath]" suffix
+// from the first findmnt call, so only the second call - checking where
+// that device is actually mounted - can tell them apart.
+func TestReconstructLocalPath_DirectoryIsOwnMountpoint(t *testing.T) {
+	plugin := fakeFindmnt(t, "/dev/sdb1 ext4\n", "/mnt/disks/vol1\n")
+
+	path, fsType, err := plugin.reconstructLocalPath("/var/lib/kubelet/pods/pod1/volumes/kubernetes.io~local-volume/pv1")
+	if err != nil {
+		t.Fatalf("reconstructLocalPath: %v", err)
+	}
+	if path != "/mnt/disks/vol1" {
+		t.Errorf("path = %q, want /mnt/disks/vol1", path)
+	}
+	if fsType != "ext4" {
+		t.Errorf("fsType = %q, want ext4", fsType)
+	}
+}
+
+func TestReconstructBlockDevicePath(t *testing.T) {
+	dir := t.TempDir()
+	mapPath := filepath.Join(dir, "volumeDevices")
+	if err := os.MkdirAll(mapPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/dev/sdd", filepath.Join(mapPath, "pv3")); err != nil {
+		t.Fatal(err)
+	}
+
+	plugin := &localVolumePlugin{}
+	path, err := plugin.reconstructBlockDevicePath("pv3", mapPath)
+	if err != nil {
+		t.Fatalf("reconstructBlockDevicePath: %v", err)
+	}
+	if path != "/dev/sdd" {
+		t.Errorf("path = %q, want /dev/sdd", path)
+	}
+}
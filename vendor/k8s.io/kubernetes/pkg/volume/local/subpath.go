@@ -0,0 +1,206 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"k8s.io/klog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/volume"
+	"k8s.io/kubernetes/pkg/volume/local/subpathallocator"
+)
+
+const (
+	// allocatorAnnotation selects an alternate consumption mode for a local
+	// PV; when set to allocatorModeSubpath, a single PV directory is carved
+	// into per-claim subdirectories instead of being bind-mounted whole.
+	allocatorAnnotation = "local.kubernetes.io/allocator"
+	// allocatorModeSubpath is the allocatorAnnotation value that enables
+	// multi-tenant subpath allocation with enforced size quotas.
+	allocatorModeSubpath = "subpath"
+
+	// duAccountingPeriod is how often startSubpathAccounting re-measures
+	// the usage of a subpath allocation.
+	duAccountingPeriod = 30 * time.Second
+
+	// subpathQuotaExceeded is the event reason recorded against a pod when
+	// its subpath allocation grows past its reserved size.
+	subpathQuotaExceeded = "SubPathQuotaExceeded"
+)
+
+// usesSubpathAllocator reports whether spec opted in to subpath allocation.
+func usesSubpathAllocator(spec *volume.Spec) bool {
+	if spec.PersistentVolume == nil {
+		return false
+	}
+	return spec.PersistentVolume.Annotations[allocatorAnnotation] == allocatorModeSubpath
+}
+
+// getSubpathAllocator lazily creates the plugin-wide allocator. It is shared
+// by all PVs that opt in to allocatorModeSubpath.
+func (plugin *localVolumePlugin) getSubpathAllocator() (*subpathallocator.Allocator, error) {
+	plugin.subpathAllocatorLock.Lock()
+	defer plugin.subpathAllocatorLock.Unlock()
+
+	if plugin.subpathAllocator == nil {
+		a, err := subpathallocator.New(plugin.host.GetPluginDir(localVolumePluginName), plugin.exec)
+		if err != nil {
+			return nil, err
+		}
+		plugin.subpathAllocator = a
+	}
+	return plugin.subpathAllocator, nil
+}
+
+// reserveSubpath reserves (or recovers) the per-claim subdirectory of the
+// PV's shared directory that backs spec, returning the path to bind-mount.
+func (plugin *localVolumePlugin) reserveSubpath(spec *volume.Spec, sharedPath string) (string, error) {
+	pv := spec.PersistentVolume
+	capacity, ok := pv.Spec.Capacity[v1.ResourceStorage]
+	if !ok {
+		return "", fmt.Errorf("local: PV %s requests subpath allocation but sets no storage capacity", spec.Name())
+	}
+
+	allocator, err := plugin.getSubpathAllocator()
+	if err != nil {
+		return "", err
+	}
+	return allocator.Reserve(sharedPath, spec.Name(), pv.UID, capacity.Value())
+}
+
+// subpathMountKey identifies a single pod's use of a subpath-allocated PV,
+// matching the lifetime of the accounting goroutine started for it.
+func subpathMountKey(volName string, podUID types.UID) string {
+	return volName + "/" + string(podUID)
+}
+
+// startSubpathAccounting periodically measures usage of a subpath
+// allocation and posts an eviction-warning event via plugin.recorder when a
+// claim has outgrown its reservation. It runs for every allocation, whether
+// or not the allocator also set an XFS project quota on it; it does not
+// check which. The goroutine runs until stopSubpathAccounting is called for
+// the same volName/podUID from TearDownAt.
+func (plugin *localVolumePlugin) startSubpathAccounting(m *localVolumeMounter, reservedBytes int64) {
+	stop := make(chan struct{})
+	key := subpathMountKey(m.volName, m.podUID)
+
+	plugin.subpathMountsMu.Lock()
+	if plugin.subpathMounts == nil {
+		plugin.subpathMounts = make(map[string]chan struct{})
+	}
+	// NewMounter (and so this call) reruns on every kubelet retry of a
+	// failed SetUp for the same pod/volume; stop any goroutine left running
+	// from an earlier attempt instead of leaking it.
+	if old, ok := plugin.subpathMounts[key]; ok {
+		close(old)
+	}
+	plugin.subpathMounts[key] = stop
+	plugin.subpathMountsMu.Unlock()
+
+	// m.globalPath is the reserved subdirectory itself (see NewMounter), not
+	// the pod's bind-mount target, so du'ing it measures only this claim's
+	// usage. m.MetricsProvider, by contrast, statfs's the bind-mount target
+	// and so always reports usage of the whole shared filesystem; it's the
+	// wrong tool for per-claim enforcement here.
+	subPath := m.globalPath
+
+	go func() {
+		ticker := time.NewTicker(duAccountingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				used, err := duUsage(subPath)
+				if err != nil {
+					klog.V(4).Infof("local: subpath accounting for %s failed: %v", subPath, err)
+					continue
+				}
+				if used > reservedBytes {
+					plugin.recorder.Eventf(m.pod, v1.EventTypeWarning, subpathQuotaExceeded,
+						"Volume %s is using %d bytes, exceeding its reserved capacity of %d bytes", m.volName, used, reservedBytes)
+				}
+			}
+		}
+	}()
+}
+
+// duUsage sums the apparent size of every regular file under path,
+// approximating `du -sb path`, to measure a single reserved subdirectory's
+// usage without involving the rest of the shared filesystem it lives on.
+func duUsage(path string) (int64, error) {
+	var total int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("local: du %s: %v", path, err)
+	}
+	return total, nil
+}
+
+// stopSubpathAccounting stops the accounting goroutine started for
+// volName/podUID, if any, and releases the allocator's reservation once no
+// other pod still bind-mounts the shared subdirectory. It is a no-op for
+// volumes that never used subpath allocation.
+func (plugin *localVolumePlugin) stopSubpathAccounting(volName string, podUID types.UID, mounter mount.Interface) {
+	key := subpathMountKey(volName, podUID)
+	plugin.subpathMountsMu.Lock()
+	stop, ok := plugin.subpathMounts[key]
+	if ok {
+		delete(plugin.subpathMounts, key)
+	}
+	plugin.subpathMountsMu.Unlock()
+	if ok {
+		close(stop)
+	}
+
+	plugin.subpathAllocatorLock.Lock()
+	allocator := plugin.subpathAllocator
+	plugin.subpathAllocatorLock.Unlock()
+	if allocator == nil {
+		return
+	}
+	sharedPath, subPath, ok := allocator.Lookup(volName)
+	if !ok {
+		return
+	}
+	refs, err := mounter.GetMountRefs(subPath)
+	if err != nil {
+		klog.Warningf("local: failed to check remaining references to %s before releasing subpath allocation: %v", subPath, err)
+		return
+	}
+	if len(refs) == 0 {
+		if err := allocator.Release(sharedPath, volName); err != nil {
+			klog.Warningf("local: failed to release subpath allocation for %s: %v", volName, err)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// +build !linux
+
+package subpathallocator
+
+import (
+	"fmt"
+
+	utilexec "k8s.io/utils/exec"
+)
+
+// enforceQuota is a no-op on platforms without XFS project quota support;
+// callers fall back to periodic du-based accounting.
+func enforceQuota(exec utilexec.Interface, path string, sizeBytes int64) error {
+	return fmt.Errorf("subpathallocator: quota enforcement is not supported on this platform")
+}
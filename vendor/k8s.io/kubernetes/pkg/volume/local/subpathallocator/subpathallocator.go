@@ -0,0 +1,174 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package subpathallocator carves a single local directory PV into
+// per-claim subdirectories with enforced size quotas, so that one
+// local PV can be shared by multiple pods.
+package subpathallocator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	utilexec "k8s.io/utils/exec"
+)
+
+// stateFileName is the name of the file, relative to the plugin dir, that
+// persists the allocator's bookkeeping across kubelet restarts.
+const stateFileName = "local-volume-allocator-state.json"
+
+// Allocation records a single reserved subdirectory of a shared global path.
+type Allocation struct {
+	// GlobalPath is the shared PV directory this subdirectory was carved
+	// out of.
+	GlobalPath string `json:"globalPath"`
+	// SubPath is the name of the subdirectory under GlobalPath; it is also
+	// the owning PV's name, since each PV gets exactly one subdirectory.
+	SubPath string `json:"subPath"`
+	// SizeBytes is the quota enforced for this allocation.
+	SizeBytes int64 `json:"sizeBytes"`
+	// PVUID is the UID of the PersistentVolume the allocation was carved from.
+	PVUID types.UID `json:"pvUID"`
+}
+
+// Allocator reserves and tracks per-claim subdirectories of a local PV's
+// globalPath, enforcing a size quota for each one.
+type Allocator struct {
+	mu    sync.Mutex
+	path  string                 // path to the persisted state file
+	byKey map[string]*Allocation // keyed by globalPath+"/"+pvName
+	// exec runs the chattr/findmnt/xfs_quota commands behind quota
+	// enforcement; it is swapped out for a fake in tests.
+	exec utilexec.Interface
+}
+
+// New creates an Allocator whose state is persisted under pluginDir and
+// whose quota enforcement shells out through exec. Existing state, if any,
+// is loaded immediately so callers can rebuild their view of the world
+// (e.g. from ConstructVolumeSpec) right away.
+func New(pluginDir string, exec utilexec.Interface) (*Allocator, error) {
+	a := &Allocator{
+		path:  filepath.Join(pluginDir, stateFileName),
+		byKey: make(map[string]*Allocation),
+		exec:  exec,
+	}
+	if err := a.load(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func key(globalPath, pvName string) string {
+	return globalPath + "/" + pvName
+}
+
+func (a *Allocator) load() error {
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("subpathallocator: failed to read state file %s: %v", a.path, err)
+	}
+	var allocations []*Allocation
+	if err := json.Unmarshal(data, &allocations); err != nil {
+		return fmt.Errorf("subpathallocator: failed to parse state file %s: %v", a.path, err)
+	}
+	for _, alloc := range allocations {
+		a.byKey[key(alloc.GlobalPath, alloc.SubPath)] = alloc
+	}
+	return nil
+}
+
+// persist writes the current allocation table to disk. Callers must hold a.mu.
+func (a *Allocator) persist() error {
+	allocations := make([]*Allocation, 0, len(a.byKey))
+	for _, alloc := range a.byKey {
+		allocations = append(allocations, alloc)
+	}
+	data, err := json.Marshal(allocations)
+	if err != nil {
+		return fmt.Errorf("subpathallocator: failed to marshal allocator state: %v", err)
+	}
+	tmp := a.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("subpathallocator: failed to write state file %s: %v", tmp, err)
+	}
+	return os.Rename(tmp, a.path)
+}
+
+// Reserve carves out (or returns the already-reserved) subdirectory of
+// globalPath for the PV identified by pvName/pvUID, creating it on disk
+// and enforcing sizeBytes as its quota. It returns the absolute path of
+// the reserved subdirectory.
+func (a *Allocator) Reserve(globalPath, pvName string, pvUID types.UID, sizeBytes int64) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	k := key(globalPath, pvName)
+	if existing, ok := a.byKey[k]; ok {
+		return filepath.Join(globalPath, existing.SubPath), nil
+	}
+
+	subPath := pvName
+	fullPath := filepath.Join(globalPath, subPath)
+	if err := os.MkdirAll(fullPath, 0750); err != nil {
+		return "", fmt.Errorf("subpathallocator: failed to create subpath %s: %v", fullPath, err)
+	}
+
+	if err := enforceQuota(a.exec, fullPath, sizeBytes); err != nil {
+		klog.Warningf("subpathallocator: could not enforce quota on %s, falling back to du accounting: %v", fullPath, err)
+	}
+
+	a.byKey[k] = &Allocation{GlobalPath: globalPath, SubPath: subPath, SizeBytes: sizeBytes, PVUID: pvUID}
+	if err := a.persist(); err != nil {
+		return "", err
+	}
+	return fullPath, nil
+}
+
+// Release drops the bookkeeping entry for globalPath/pvName. It does not
+// remove the subdirectory itself; that is left to the caller so data can
+// be inspected after the claim is gone.
+func (a *Allocator) Release(globalPath, pvName string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.byKey, key(globalPath, pvName))
+	return a.persist()
+}
+
+// Lookup returns the globalPath a subdirectory was reserved from and the
+// reserved subdirectory itself for pvName. Unlike Reserve/Release, callers
+// don't need globalPath on hand to use it: ConstructVolumeSpec only knows
+// the PV's name when it rebuilds the mapping after a kubelet restart.
+func (a *Allocator) Lookup(pvName string) (globalPath, subPath string, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, alloc := range a.byKey {
+		if alloc.SubPath == pvName {
+			return alloc.GlobalPath, filepath.Join(alloc.GlobalPath, alloc.SubPath), true
+		}
+	}
+	return "", "", false
+}
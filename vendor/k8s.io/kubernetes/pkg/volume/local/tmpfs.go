@@ -0,0 +1,113 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/klog"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+const (
+	tmpfsScheme = "tmpfs://"
+	ramfsScheme = "ramfs://"
+
+	tmpfsFSType = "tmpfs"
+	ramfsFSType = "ramfs"
+)
+
+// parseMemBackedSource recognizes LocalVolumeSource.Path directives of the
+// form "tmpfs://<size>" or "ramfs://<size>", giving node-local scratch space
+// backed by memory instead of a real block device or directory. size may be
+// empty, in which case the PV's Capacity is used instead.
+func parseMemBackedSource(path string) (fsType string, size string, ok bool) {
+	switch {
+	case strings.HasPrefix(path, tmpfsScheme):
+		return tmpfsFSType, strings.TrimPrefix(path, tmpfsScheme), true
+	case strings.HasPrefix(path, ramfsScheme):
+		return ramfsFSType, strings.TrimPrefix(path, ramfsScheme), true
+	}
+	return "", "", false
+}
+
+// resolveMemBackedSize picks the tmpfs/ramfs size= mount option, as a raw
+// byte count: Linux only accepts single-letter k/m/g suffixes or a bare
+// number for tmpfs/ramfs size=, not Kubernetes' Ki/Mi/Gi binary notation.
+// It uses the size embedded in the Path directive if present, otherwise the
+// PV's requested storage capacity.
+func resolveMemBackedSize(spec *volume.Spec, sizeDirective string) (string, error) {
+	if sizeDirective != "" {
+		quantity, err := resource.ParseQuantity(sizeDirective)
+		if err != nil {
+			return "", fmt.Errorf("local: volume %s has an invalid size in its Path directive %q: %v", spec.Name(), sizeDirective, err)
+		}
+		return fmt.Sprintf("%d", quantity.Value()), nil
+	}
+	if capacity, ok := spec.PersistentVolume.Spec.Capacity[v1.ResourceStorage]; ok {
+		return fmt.Sprintf("%d", capacity.Value()), nil
+	}
+	return "", fmt.Errorf("local: volume %s specifies no size in its Path directive or Capacity", spec.Name())
+}
+
+// mountMemBackedVolume mounts a fresh tmpfs/ramfs of the requested size at
+// deviceMountPath. Teardown is handled by the existing UnmountDevice path:
+// it unmounts whatever is at deviceMountPath regardless of filesystem type.
+func (dm *deviceMounter) mountMemBackedVolume(spec *volume.Spec, fsType, sizeDirective, deviceMountPath string) error {
+	notMnt, err := dm.mounter.IsLikelyNotMountPoint(deviceMountPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(deviceMountPath, 0750); err != nil {
+				return err
+			}
+			notMnt = true
+		} else {
+			return err
+		}
+	}
+	if !notMnt {
+		return nil
+	}
+
+	size, err := resolveMemBackedSize(spec, sizeDirective)
+	if err != nil {
+		return err
+	}
+
+	// Unlike tmpfs, ramfs grows to fill memory and the kernel silently
+	// ignores its size= mount option, so passing one here would only
+	// pretend to enforce a limit it can't deliver. Skip the option and warn
+	// instead: an operator relying on a ramfs PV's size to bound node
+	// memory usage is not actually protected.
+	var options []string
+	if fsType == ramfsFSType {
+		klog.Warningf("local: volume %s requests ramfs with size %s, but ramfs has no enforced size limit and can exhaust node memory", spec.Name(), size)
+	} else {
+		options = []string{fmt.Sprintf("size=%s", size)}
+	}
+	if err := dm.mounter.Mount(fsType, deviceMountPath, fsType, options); err != nil {
+		os.Remove(deviceMountPath)
+		return fmt.Errorf("local: failed to mount %s (size=%s) at %s: %v", fsType, size, deviceMountPath, err)
+	}
+	klog.V(3).Infof("local: mounted %s (size=%s) at %s", fsType, size, deviceMountPath)
+	return nil
+}
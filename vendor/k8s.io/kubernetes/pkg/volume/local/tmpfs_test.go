@@ -0,0 +1,97 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package local
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/kubernetes/pkg/volume"
+)
+
+func TestParseMemBackedSource(t *testing.T) {
+	cases := []struct {
+		path       string
+		wantFSType string
+		wantSize   string
+		wantOK     bool
+	}{
+		{"tmpfs://10Gi", "tmpfs", "10Gi", true},
+		{"ramfs://512Mi", "ramfs", "512Mi", true},
+		{"tmpfs://", "tmpfs", "", true},
+		{"/mnt/disks/vol1", "", "", false},
+	}
+	for _, c := range cases {
+		fsType, size, ok := parseMemBackedSource(c.path)
+		if ok != c.wantOK || fsType != c.wantFSType || size != c.wantSize {
+			t.Errorf("parseMemBackedSource(%q) = (%q, %q, %v), want (%q, %q, %v)",
+				c.path, fsType, size, ok, c.wantFSType, c.wantSize, c.wantOK)
+		}
+	}
+}
+
+func specWithCapacity(capacity string) *volume.Spec {
+	pv := &v1.PersistentVolume{
+		Spec: v1.PersistentVolumeSpec{
+			Capacity: v1.ResourceList{
+				v1.ResourceStorage: resource.MustParse(capacity),
+			},
+		},
+	}
+	return volume.NewSpecFromPersistentVolume(pv, false)
+}
+
+func TestResolveMemBackedSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		sizeDirective string
+		capacity      string
+		want          string
+		wantErr       bool
+	}{
+		{name: "Gi directive converts to bytes", sizeDirective: "10Gi", want: "10737418240"},
+		{name: "Mi directive converts to bytes", sizeDirective: "512Mi", want: "536870912"},
+		{name: "directive takes precedence over capacity", sizeDirective: "1Gi", capacity: "2Gi", want: "1073741824"},
+		{name: "falls back to capacity, converted to bytes", capacity: "1Gi", want: "1073741824"},
+		{name: "invalid directive is an error", sizeDirective: "not-a-size", wantErr: true},
+		{name: "neither directive nor capacity is an error", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var spec *volume.Spec
+			if c.capacity != "" {
+				spec = specWithCapacity(c.capacity)
+			} else {
+				spec = volume.NewSpecFromPersistentVolume(&v1.PersistentVolume{}, false)
+			}
+			got, err := resolveMemBackedSize(spec, c.sizeDirective)
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("resolveMemBackedSize(%q) = %q, want an error", c.sizeDirective, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveMemBackedSize(%q) returned unexpected error: %v", c.sizeDirective, err)
+			}
+			if got != c.want {
+				t.Errorf("resolveMemBackedSize(%q) = %q, want %q", c.sizeDirective, got, c.want)
+			}
+		})
+	}
+}
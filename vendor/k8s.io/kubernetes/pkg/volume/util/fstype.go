@@ -0,0 +1,57 @@
+/*
+Copyright 2019 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import (
+	"strings"
+
+	utilexec "k8s.io/utils/exec"
+)
+
+// DetectDeviceFSType probes devicePath for an existing filesystem using
+// blkid, falling back to lsblk if blkid is unavailable or inconclusive. It
+// returns "" (with a nil error) if the device has no recognizable
+// filesystem yet. exec runs the blkid/lsblk commands so callers can swap in
+// a fake for tests.
+func DetectDeviceFSType(exec utilexec.Interface, devicePath string) (string, error) {
+	fsType, err := blkidFSType(exec, devicePath)
+	if err == nil && fsType != "" {
+		return fsType, nil
+	}
+	return lsblkFSType(exec, devicePath)
+}
+
+func blkidFSType(exec utilexec.Interface, devicePath string) (string, error) {
+	out, err := exec.Command("blkid", "-o", "value", "-s", "TYPE", devicePath).CombinedOutput()
+	if err != nil {
+		// blkid exits 2 when the device has no recognizable filesystem;
+		// that is not an error for our purposes.
+		if exitErr, ok := err.(utilexec.ExitError); ok && exitErr.ExitStatus() == 2 {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func lsblkFSType(exec utilexec.Interface, devicePath string) (string, error) {
+	out, err := exec.Command("lsblk", "-n", "-o", "FSTYPE", devicePath).CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}